@@ -2,13 +2,21 @@ package terraform
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/terraform/config"
 	"github.com/hashicorp/terraform/dag"
 )
 
 // GraphNodeReferenceable must be implemented by any node that represents
 // a Terraform thing that can be referenced (resource, module, etc.).
+//
+// Deprecated: implement GraphNodeReferenceableAddr instead. ReferenceMap
+// still honors this interface by parsing each name with ParseReference,
+// but the structured form is required to express things like splat
+// index or a module path distinct from the name.
 type GraphNodeReferenceable interface {
 	// ReferenceableName is the name by which this can be referenced.
 	// This can be either just the type, or include the field. Example:
@@ -18,6 +26,9 @@ type GraphNodeReferenceable interface {
 
 // GraphNodeReferencer must be implemented by nodes that reference other
 // Terraform items and therefore depend on them.
+//
+// Deprecated: implement GraphNodeReferencerAddr instead. See
+// GraphNodeReferenceable.
 type GraphNodeReferencer interface {
 	// References are the list of things that this node references. This
 	// can include fields or just the type, just like GraphNodeReferenceable
@@ -25,6 +36,32 @@ type GraphNodeReferencer interface {
 	References() []string
 }
 
+// GraphNodeReferenceableAddr is the Reference-based counterpart to
+// GraphNodeReferenceable. Node kinds that need to register more than a
+// dotted string can express should implement this directly; ReferenceMap
+// prefers it over GraphNodeReferenceable when both are implemented.
+type GraphNodeReferenceableAddr interface {
+	// ReferenceableAddrs is the set of references by which this node
+	// can be referenced.
+	ReferenceableAddrs() []*Reference
+}
+
+// GraphNodeReferencerAddr is the Reference-based counterpart to
+// GraphNodeReferencer. See GraphNodeReferenceableAddr.
+type GraphNodeReferencerAddr interface {
+	// ReferenceAddrs is the set of things that this node references.
+	ReferenceAddrs() []*Reference
+}
+
+// GraphNodeExplicitReferencer can be implemented by nodes that know they
+// depend on other nodes via an explicit `depends_on` configuration
+// entry, as opposed to references discovered through interpolation.
+type GraphNodeExplicitReferencer interface {
+	// DependsOn is the list of additional things this node depends on,
+	// in the same dotted-string form as GraphNodeReferencer.References.
+	DependsOn() []string
+}
+
 // GraphNodeReferenceGlobal is an interface that can optionally be
 // implemented. If ReferenceGlobal returns true, then the References()
 // and ReferenceableName() must be _fully qualified_ with "module.foo.bar"
@@ -41,6 +78,185 @@ type GraphNodeReferenceGlobal interface {
 	ReferenceGlobal() bool
 }
 
+// ReferenceSubject classifies the kind of thing a Reference points at.
+type ReferenceSubject int
+
+const (
+	ReferenceSubjectResource ReferenceSubject = iota
+	ReferenceSubjectModule
+	ReferenceSubjectVar
+	ReferenceSubjectLocal
+	ReferenceSubjectData
+	ReferenceSubjectSelf
+)
+
+const (
+	// ReferenceIndexNone means the reference is not to a specific
+	// element of a multi-count resource.
+	ReferenceIndexNone = -1
+
+	// ReferenceIndexAll means the reference is a splat expression,
+	// matching every instance of a multi-count resource.
+	ReferenceIndexAll = -2
+)
+
+// Reference is a structured pointer to a referenceable thing in the
+// configuration: a resource, a module output, an input variable, a
+// local value, a data source, or "self" within a provisioner or
+// connection block. It replaces ad-hoc dotted strings so that new
+// subjects (and fields like an index or a module path) can be added
+// without string parsing in every GraphNodeReferenceable/
+// GraphNodeReferencer implementation.
+type Reference struct {
+	Subject    ReferenceSubject
+	Name       string
+	Field      string
+	Index      int
+	ModulePath []string
+}
+
+// String returns the dotted-string form of this reference. It is used
+// both as the ReferenceMap lookup key and in user-facing diagnostics, so
+// it must remain the inverse of ParseReference for any string that
+// ParseReference can produce.
+func (r *Reference) String() string {
+	var s string
+	switch r.Subject {
+	case ReferenceSubjectModule:
+		s = fmt.Sprintf("module.%s.output.%s", r.Name, r.Field)
+	case ReferenceSubjectVar:
+		s = fmt.Sprintf("var.%s", r.Name)
+	case ReferenceSubjectLocal:
+		s = fmt.Sprintf("local.%s", r.Name)
+	case ReferenceSubjectData:
+		s = "data." + r.indexedName()
+	case ReferenceSubjectSelf:
+		s = fmt.Sprintf("self.%s", r.Field)
+	default:
+		s = r.indexedName()
+	}
+
+	if len(r.ModulePath) > 1 {
+		return modulePrefixStr(normalizeModulePath(r.ModulePath)) + "." + s
+	}
+
+	return s
+}
+
+// indexedName renders Name, optionally followed by an index or splat
+// segment and a field, e.g. "aws_instance.bar.0.id" or
+// "aws_instance.bar.*.id".
+func (r *Reference) indexedName() string {
+	parts := []string{r.Name}
+
+	switch {
+	case r.Index == ReferenceIndexAll:
+		parts = append(parts, "*")
+	case r.Index != ReferenceIndexNone:
+		parts = append(parts, strconv.Itoa(r.Index))
+	}
+
+	if r.Field != "" {
+		parts = append(parts, r.Field)
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// ParseReference parses the dotted-string form of a reference, as
+// produced by a legacy GraphNodeReferenceable/GraphNodeReferencer
+// implementation, into its structured equivalent. It does not attempt
+// to resolve a module path prefix; callers attach ModulePath separately
+// based on the vertex the reference came from.
+func ParseReference(raw string) *Reference {
+	parts := strings.Split(raw, ".")
+
+	switch parts[0] {
+	case "module":
+		if len(parts) >= 4 && parts[2] == "output" {
+			return &Reference{
+				Subject: ReferenceSubjectModule,
+				Name:    parts[1],
+				Field:   strings.Join(parts[3:], "."),
+				Index:   ReferenceIndexNone,
+			}
+		}
+	case "var":
+		return &Reference{
+			Subject: ReferenceSubjectVar,
+			Name:    strings.Join(parts[1:], "."),
+			Index:   ReferenceIndexNone,
+		}
+	case "local":
+		return &Reference{
+			Subject: ReferenceSubjectLocal,
+			Name:    strings.Join(parts[1:], "."),
+			Index:   ReferenceIndexNone,
+		}
+	case "self":
+		return &Reference{
+			Subject: ReferenceSubjectSelf,
+			Field:   strings.Join(parts[1:], "."),
+			Index:   ReferenceIndexNone,
+		}
+	case "data":
+		if len(parts) >= 3 {
+			r := parseIndexedReference(parts[1:])
+			r.Subject = ReferenceSubjectData
+			return r
+		}
+	}
+
+	return parseIndexedReference(parts)
+}
+
+// parseIndexedReference parses the "type.name[.index|.*][.field...]"
+// form shared by resource and data source references.
+func parseIndexedReference(parts []string) *Reference {
+	r := &Reference{Subject: ReferenceSubjectResource, Index: ReferenceIndexNone}
+	if len(parts) < 2 {
+		r.Name = strings.Join(parts, ".")
+		return r
+	}
+
+	r.Name = parts[0] + "." + parts[1]
+	rest := parts[2:]
+
+	if len(rest) > 0 {
+		if rest[0] == "*" {
+			r.Index = ReferenceIndexAll
+			rest = rest[1:]
+		} else if i, err := strconv.Atoi(rest[0]); err == nil {
+			r.Index = i
+			rest = rest[1:]
+		}
+	}
+
+	r.Field = strings.Join(rest, ".")
+	return r
+}
+
+// ReferenceEdge is a dag.Edge between two nodes connected by a
+// reference. Explicit is true when the edge came from a `depends_on`
+// entry rather than an interpolated variable, which lets later
+// transformers and visualizers (e.g. `terraform graph`) distinguish the
+// two instead of treating every dependency edge alike.
+type ReferenceEdge struct {
+	S, T     dag.Vertex
+	Explicit bool
+}
+
+func (e *ReferenceEdge) Source() dag.Vertex { return e.S }
+func (e *ReferenceEdge) Target() dag.Vertex { return e.T }
+
+// Hashcode includes Explicit so that an implicit and an explicit edge
+// between the same two vertices are kept distinct rather than deduping
+// to whichever was added first, which would silently drop the marker
+// this type exists to carry.
+func (e *ReferenceEdge) Hashcode() interface{} {
+	return fmt.Sprintf("%p-%p-%t", e.S, e.T, e.Explicit)
+}
+
 // ReferenceTransformer is a GraphTransformer that connects all the
 // nodes that reference each other in order to form the proper ordering.
 type ReferenceTransformer struct{}
@@ -50,15 +266,69 @@ func (t *ReferenceTransformer) Transform(g *Graph) error {
 	vs := g.Vertices()
 	m := NewReferenceMap(vs)
 
-	// Find the things that reference things and connect them
+	// refGraph mirrors just the edges this transformer adds, so that
+	// the cycle check below only considers reference-induced cycles and
+	// not edges belonging to whatever else has already run against g.
+	refGraph := &dag.AcyclicGraph{}
 	for _, v := range vs {
-		parents, _ := m.References(v)
+		refGraph.Add(v)
+	}
+
+	// Find the things that reference things and connect them. A
+	// reference that can't be resolved here isn't necessarily invalid:
+	// at this stage of graph construction, some of the things it could
+	// name (e.g. a resource inside a module that hasn't been expanded
+	// yet) may not have a vertex. Surfacing that as a hard failure is
+	// left to a later validation pass that runs once the graph is
+	// fully built.
+	var diags error
+	connect := func(v dag.Vertex, parents []dag.Vertex, explicit bool) {
 		for _, parent := range parents {
-			g.Connect(dag.BasicEdge(v, parent))
+			g.Connect(&ReferenceEdge{S: v, T: parent, Explicit: explicit})
+			refGraph.Connect(dag.BasicEdge(v, parent))
 		}
 	}
 
-	return nil
+	for _, v := range vs {
+		parents, _ := m.References(v)
+		connect(v, parents, false)
+
+		if dn, ok := v.(GraphNodeExplicitReferencer); ok {
+			parents, missing := m.DependsOn(v, dn.DependsOn())
+			connect(v, parents, true)
+
+			// Unlike an unresolved name, a depends_on entry that
+			// resolves back to its own resource is always wrong: both
+			// vertices already exist at this point, so there's no
+			// question of the reference simply not existing yet.
+			for _, n := range missing {
+				if strings.HasSuffix(n, selfDependencyNote) {
+					diags = multierror.Append(diags, fmt.Errorf(
+						"%s: %s", dag.VertexName(v), n))
+				}
+			}
+		}
+	}
+
+	// Now that all of the reference edges are in place, look for any
+	// cycles among them. A cycle here means the configuration can never
+	// be walked successfully, so we report it up front with the full
+	// path rather than letting callers hit a confusing failure partway
+	// through a later walk.
+	for _, cycle := range refGraph.Cycles() {
+		if len(cycle) <= 1 {
+			continue
+		}
+
+		names := make([]string, len(cycle))
+		for i, v := range cycle {
+			names[i] = dag.VertexName(v)
+		}
+		diags = multierror.Append(diags, fmt.Errorf(
+			"Cycle: %s", strings.Join(names, " -> ")))
+	}
+
+	return diags
 }
 
 // ReferenceMap is a structure that can be used to efficiently check
@@ -72,19 +342,52 @@ type ReferenceMap struct {
 // References returns the list of vertices that this vertex
 // references along with any missing references.
 func (m *ReferenceMap) References(v dag.Vertex) ([]dag.Vertex, []string) {
-	rn, ok := v.(GraphNodeReferencer)
-	if !ok {
+	return m.resolve(v, referenceAddrs(v), false)
+}
+
+// DependsOn resolves the raw, dotted-string form of an explicit
+// `depends_on` entry (as returned by GraphNodeExplicitReferencer) to the
+// vertices it names, along with any that couldn't be resolved. Unlike an
+// interpolated reference, an explicit depends_on entry can only ever
+// name its own resource by mistake, so a self-reference is reported
+// rather than silently dropped.
+func (m *ReferenceMap) DependsOn(v dag.Vertex, rawDependsOn []string) ([]dag.Vertex, []string) {
+	if len(rawDependsOn) == 0 {
+		return nil, nil
+	}
+
+	refs := make([]*Reference, len(rawDependsOn))
+	for i, n := range rawDependsOn {
+		refs[i] = ParseReference(n)
+	}
+
+	return m.resolve(v, refs, true)
+}
+
+// selfDependencyNote is appended to a missing-reference string by
+// resolve to flag that it wasn't merely unresolved but names the
+// referencing vertex's own resource, which is always a mistake.
+const selfDependencyNote = " (a resource cannot depend on itself)"
+
+// resolve is the shared lookup used by both interpolation-derived
+// references and explicit depends_on references. reportSelfRef controls
+// whether a reference that resolves back to v itself is surfaced as an
+// error (explicit depends_on) or silently excluded (interpolation,
+// where e.g. "aws_instance.foo.0.id" used inside aws_instance.foo
+// legitimately loops back).
+func (m *ReferenceMap) resolve(v dag.Vertex, refs []*Reference, reportSelfRef bool) ([]dag.Vertex, []string) {
+	if refs == nil {
 		return nil, nil
 	}
 
 	var matches []dag.Vertex
 	var missing []string
-	prefix := m.prefix(v)
-	for _, n := range rn.References() {
-		n = prefix + n
-		parents, ok := m.m[n]
+	path := m.modulePath(v)
+	for _, r := range refs {
+		r.ModulePath = path
+		parents, ok := m.lookup(r)
 		if !ok {
-			missing = append(missing, n)
+			missing = append(missing, r.String())
 			continue
 		}
 
@@ -97,6 +400,9 @@ func (m *ReferenceMap) References(v dag.Vertex) ([]dag.Vertex, []string) {
 			}
 		}
 		if selfRef {
+			if reportSelfRef {
+				missing = append(missing, r.String()+selfDependencyNote)
+			}
 			continue
 		}
 
@@ -106,22 +412,182 @@ func (m *ReferenceMap) References(v dag.Vertex) ([]dag.Vertex, []string) {
 	return matches, missing
 }
 
-func (m *ReferenceMap) prefix(v dag.Vertex) string {
+// MissingReferenceErrors renders the unresolved references returned
+// alongside References/DependsOn as actionable diagnostics, complete
+// with a fuzzy-matched suggestion where one is close enough.
+// ReferenceTransformer deliberately doesn't call this for every miss
+// itself, since at graph-build time an unresolved reference isn't
+// necessarily invalid (see Transform); it's here for a later pass that
+// validates the fully-built graph, where a miss really is an error.
+func (m *ReferenceMap) MissingReferenceErrors(v dag.Vertex, missing []string) []error {
+	errs := make([]error, 0, len(missing))
+	for _, n := range missing {
+		errs = append(errs, m.missingErr(v, n))
+	}
+
+	return errs
+}
+
+// missingErr builds a precise, user-facing diagnostic for a reference
+// that couldn't be resolved, naming the referencing vertex, the
+// unresolved reference itself, and (if one is close enough) the
+// referenceable name it was probably meant to be.
+func (m *ReferenceMap) missingErr(v dag.Vertex, n string) error {
+	if suggestion := m.closest(n); suggestion != "" {
+		return fmt.Errorf(
+			"%s: reference to %q could not be resolved. Did you mean %q?",
+			dag.VertexName(v), n, suggestion)
+	}
+
+	return fmt.Errorf(
+		"%s: reference to %q could not be resolved.",
+		dag.VertexName(v), n)
+}
+
+// closest returns the referenceable name in the map that is the best
+// fuzzy match for n, or "" if nothing is close enough to be a useful
+// suggestion.
+func (m *ReferenceMap) closest(n string) string {
+	const maxDistance = 3
+
+	var best string
+	bestDistance := maxDistance + 1
+	for k := range m.m {
+		d := levenshtein(n, k)
+		if d < bestDistance {
+			best = k
+			bestDistance = d
+		}
+	}
+
+	if bestDistance > maxDistance {
+		return ""
+	}
+
+	return best
+}
+
+// levenshtein returns the Levenshtein edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	la, lb := len(ra), len(rb)
+
+	row := make([]int, lb+1)
+	for j := 0; j <= lb; j++ {
+		row[j] = j
+	}
+
+	for i := 1; i <= la; i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= lb; j++ {
+			cur := row[j]
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			min := row[j] + 1 // deletion
+			if v := row[j-1] + 1; v < min {
+				min = v // insertion
+			}
+			if v := prev + cost; v < min {
+				min = v // substitution
+			}
+
+			row[j] = min
+			prev = cur
+		}
+	}
+
+	return row[lb]
+}
+
+// lookup resolves a reference to the vertices that implement it.
+// Referenceable nodes only ever register the bare resource/data name
+// (the graph has one node per resource regardless of its count, and
+// doesn't track individual fields), so a reference with an index/splat
+// segment (e.g. "aws_instance.bar.0.id", "aws_instance.bar.*.id") or
+// simply a field (e.g. "aws_instance.bar.id") falls back to matching
+// against that bare name instead.
+func (m *ReferenceMap) lookup(r *Reference) ([]dag.Vertex, bool) {
+	if parents, ok := m.m[r.String()]; ok {
+		return parents, true
+	}
+
+	base := *r
+	base.Index = ReferenceIndexNone
+	if parents, ok := m.m[base.String()]; ok {
+		return parents, true
+	}
+
+	base.Field = ""
+	if parents, ok := m.m[base.String()]; ok {
+		return parents, true
+	}
+
+	return nil, false
+}
+
+// modulePath returns the module path that should be attached to any
+// Reference registered or looked up on behalf of v, or nil if v's
+// references are already fully module-qualified.
+func (m *ReferenceMap) modulePath(v dag.Vertex) []string {
 	// If the node is stating it is already fully qualified then
-	// we don't have to create the prefix!
+	// it carries its own module path, if any.
 	if gn, ok := v.(GraphNodeReferenceGlobal); ok && gn.ReferenceGlobal() {
-		return ""
+		return nil
 	}
 
-	// Create the prefix based on the path
-	var prefix string
 	if pn, ok := v.(GraphNodeSubPath); ok {
 		if path := normalizeModulePath(pn.Path()); len(path) > 1 {
-			prefix = modulePrefixStr(path) + "."
+			return path
 		}
 	}
 
-	return prefix
+	return nil
+}
+
+// referenceableAddrs returns the References by which v can be
+// referenced, preferring GraphNodeReferenceableAddr and falling back to
+// parsing the dotted strings from the deprecated GraphNodeReferenceable.
+func referenceableAddrs(v dag.Vertex) []*Reference {
+	if rn, ok := v.(GraphNodeReferenceableAddr); ok {
+		return rn.ReferenceableAddrs()
+	}
+
+	rn, ok := v.(GraphNodeReferenceable)
+	if !ok {
+		return nil
+	}
+
+	var result []*Reference
+	for _, n := range rn.ReferenceableName() {
+		result = append(result, ParseReference(n))
+	}
+
+	return result
+}
+
+// referenceAddrs returns the References that v depends on, preferring
+// GraphNodeReferencerAddr and falling back to parsing the dotted strings
+// from the deprecated GraphNodeReferencer.
+func referenceAddrs(v dag.Vertex) []*Reference {
+	if rn, ok := v.(GraphNodeReferencerAddr); ok {
+		return rn.ReferenceAddrs()
+	}
+
+	rn, ok := v.(GraphNodeReferencer)
+	if !ok {
+		return nil
+	}
+
+	var result []*Reference
+	for _, n := range rn.References() {
+		result = append(result, ParseReference(n))
+	}
+
+	return result
 }
 
 // NewReferenceMap is used to create a new reference map for the
@@ -132,17 +598,15 @@ func NewReferenceMap(vs []dag.Vertex) *ReferenceMap {
 	// Build the lookup table
 	refMap := make(map[string][]dag.Vertex)
 	for _, v := range vs {
-		// We're only looking for referenceable nodes
-		rn, ok := v.(GraphNodeReferenceable)
-		if !ok {
+		refs := referenceableAddrs(v)
+		if refs == nil {
 			continue
 		}
 
-		// Go through and cache them
-		prefix := m.prefix(v)
-		for _, n := range rn.ReferenceableName() {
-			n = prefix + n
-			refMap[n] = append(refMap[n], v)
+		path := m.modulePath(v)
+		for _, r := range refs {
+			r.ModulePath = path
+			refMap[r.String()] = append(refMap[r.String()], v)
 		}
 	}
 
@@ -155,26 +619,39 @@ func NewReferenceMap(vs []dag.Vertex) *ReferenceMap {
 func ReferencesFromConfig(c *config.RawConfig) []string {
 	var result []string
 	for _, v := range c.Variables {
-		if r := ReferenceFromInterpolatedVar(v); r != "" {
-			result = append(result, r)
-		}
-
+		result = append(result, ReferenceFromInterpolatedVar(v)...)
 	}
 
 	return result
 }
 
-// ReferenceFromInterpolatedVar returns the reference from this variable,
-// or an empty string if there is no reference.
-func ReferenceFromInterpolatedVar(v config.InterpolatedVariable) string {
+// ReferenceFromInterpolatedVar returns the references from this variable,
+// or nil if there is no reference. Each variable yields at most one
+// reference; a splat reference (e.g. "aws_instance.bar.*.id") or an
+// indexed reference into a specific instance (e.g.
+// "aws_instance.bar.0.id") is returned in that splat or indexed form.
+func ReferenceFromInterpolatedVar(v config.InterpolatedVariable) []string {
 	switch v := v.(type) {
 	case *config.ModuleVariable:
-		return fmt.Sprintf("module.%s.output.%s", v.Name, v.Field)
+		return []string{fmt.Sprintf("module.%s.output.%s", v.Name, v.Field)}
 	case *config.ResourceVariable:
-		return v.ResourceId()
+		id := v.ResourceId()
+
+		// If this is a reference to a multi-count resource, build the
+		// indexed or splat form so it can be matched against every
+		// instance of that resource rather than falling through to
+		// "missing".
+		if v.Multi && v.Index == -1 {
+			return []string{fmt.Sprintf("%s.*.%s", id, v.Field)}
+		}
+		if v.Multi {
+			return []string{fmt.Sprintf("%s.%d.%s", id, v.Index, v.Field)}
+		}
+
+		return []string{fmt.Sprintf("%s.%s", id, v.Field)}
 	case *config.UserVariable:
-		return fmt.Sprintf("var.%s", v.Name)
+		return []string{fmt.Sprintf("var.%s", v.Name)}
 	default:
-		return ""
+		return nil
 	}
 }
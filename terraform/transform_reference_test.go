@@ -0,0 +1,118 @@
+package terraform
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform/dag"
+)
+
+func TestReferenceParseString(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+	}{
+		{"resource", "aws_instance.bar.id"},
+		{"resource no field", "aws_instance.bar"},
+		{"resource index", "aws_instance.bar.0.id"},
+		{"resource splat", "aws_instance.bar.*.id"},
+		{"data", "data.aws_ami.foo.id"},
+		{"module output", "module.foo.output.bar"},
+		{"var", "var.foo"},
+		{"local", "local.foo"},
+		{"self", "self.id"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := ParseReference(tc.raw)
+			if got := r.String(); got != tc.raw {
+				t.Fatalf("ParseReference(%q).String() = %q, want %q", tc.raw, got, tc.raw)
+			}
+		})
+	}
+}
+
+type testReferenceableNode struct {
+	addrs []*Reference
+}
+
+func (n *testReferenceableNode) ReferenceableAddrs() []*Reference { return n.addrs }
+
+type testReferencerNode struct {
+	addrs []*Reference
+}
+
+func (n *testReferencerNode) ReferenceAddrs() []*Reference { return n.addrs }
+
+func TestReferenceMapLookup(t *testing.T) {
+	target := &testReferenceableNode{
+		addrs: []*Reference{{Subject: ReferenceSubjectResource, Name: "aws_instance.bar", Index: ReferenceIndexNone}},
+	}
+
+	m := NewReferenceMap([]dag.Vertex{target})
+
+	cases := []struct {
+		name string
+		ref  *Reference
+	}{
+		{"plain field", &Reference{Subject: ReferenceSubjectResource, Name: "aws_instance.bar", Field: "id", Index: ReferenceIndexNone}},
+		{"indexed field", &Reference{Subject: ReferenceSubjectResource, Name: "aws_instance.bar", Field: "id", Index: 0}},
+		{"splat field", &Reference{Subject: ReferenceSubjectResource, Name: "aws_instance.bar", Field: "id", Index: ReferenceIndexAll}},
+		{"bare name", &Reference{Subject: ReferenceSubjectResource, Name: "aws_instance.bar", Index: ReferenceIndexNone}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			referencer := &testReferencerNode{addrs: []*Reference{tc.ref}}
+			matches, missing := m.References(referencer)
+			if len(missing) != 0 {
+				t.Fatalf("got missing references %v, want none", missing)
+			}
+			if !reflect.DeepEqual(matches, []dag.Vertex{target}) {
+				t.Fatalf("got matches %v, want [%v]", matches, target)
+			}
+		})
+	}
+}
+
+func TestReferenceMapMissingReferenceErrors(t *testing.T) {
+	target := &testReferenceableNode{
+		addrs: []*Reference{{Subject: ReferenceSubjectResource, Name: "aws_instance.bar", Index: ReferenceIndexNone}},
+	}
+	m := NewReferenceMap([]dag.Vertex{target})
+
+	referencer := &testReferencerNode{
+		addrs: []*Reference{{Subject: ReferenceSubjectResource, Name: "aws_instance.baz", Field: "id", Index: ReferenceIndexNone}},
+	}
+	_, missing := m.References(referencer)
+	if len(missing) != 1 {
+		t.Fatalf("got %d missing references, want 1", len(missing))
+	}
+
+	errs := m.MissingReferenceErrors(referencer, missing)
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1", len(errs))
+	}
+	if errs[0] == nil {
+		t.Fatal("got nil error")
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "abc", 0},
+		{"aws_instance.bar", "aws_instance.baz", 1},
+		{"kitten", "sitting", 3},
+	}
+
+	for _, tc := range cases {
+		if got := levenshtein(tc.a, tc.b); got != tc.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}